@@ -0,0 +1,214 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// maxSlotsPerSubject bounds how many open slots a single authenticated
+// subject may hold at once, so that sitting on a pile of valid tokens can't
+// starve the slot pool until they all hit slotTimeout. A slot stays charged
+// from booking until freeslot, so joined slots that are still relaying
+// count too, not only booked-but-unjoined ones.
+const maxSlotsPerSubject = 20
+
+// authToken is the payload carried by a short-lived HMAC-signed token that
+// authorises booking a slot, when -auth-secret is set.
+type authToken struct {
+	Exp  int64  `json:"exp"`            // unix seconds
+	Sub  string `json:"sub"`            // subject the booked-slot quota is charged against
+	Slot string `json:"slot,omitempty"` // if set, the token only authorises this exact slot
+}
+
+// authcfg holds the server's auth and rate-limiting configuration, set from
+// flags in server(). A nil secret means -auth-secret wasn't set, in which
+// case /s/ accepts any request, same as before this existed.
+var authcfg = struct {
+	secret []byte
+	rate   float64 // requests per minute per remote IP; 0 disables limiting
+
+	mu       sync.Mutex
+	limiters map[string]*rate.Limiter
+	quota    map[string]int    // subject -> number of open slots booked
+	subjects map[string]string // slot -> subject it's charged against
+}{
+	limiters: make(map[string]*rate.Limiter),
+	quota:    make(map[string]int),
+	subjects: make(map[string]string),
+}
+
+func signToken(secret []byte, tok authToken) (string, error) {
+	payload, err := json.Marshal(tok)
+	if err != nil {
+		return "", err
+	}
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(payload)
+	return base64.RawURLEncoding.EncodeToString(payload) + "." +
+		base64.RawURLEncoding.EncodeToString(mac.Sum(nil)), nil
+}
+
+func verifyToken(secret []byte, s string) (authToken, error) {
+	var tok authToken
+	payloadPart, sigPart, ok := strings.Cut(s, ".")
+	if !ok {
+		return tok, errors.New("malformed token")
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(payloadPart)
+	if err != nil {
+		return tok, err
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(sigPart)
+	if err != nil {
+		return tok, err
+	}
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(payload)
+	if !hmac.Equal(sig, mac.Sum(nil)) {
+		return tok, errors.New("invalid token signature")
+	}
+	if err := json.Unmarshal(payload, &tok); err != nil {
+		return tok, err
+	}
+	if time.Now().Unix() > tok.Exp {
+		return tok, errors.New("token expired")
+	}
+	return tok, nil
+}
+
+// authenticate extracts and verifies the HMAC token from the Authorization
+// header or ?t= query. ok is true either when auth is disabled (no
+// -auth-secret configured) or the token is valid, so callers can reject
+// unconditionally on !ok.
+func authenticate(r *http.Request) (tok authToken, ok bool) {
+	if authcfg.secret == nil {
+		return authToken{}, true
+	}
+	s := r.URL.Query().Get("t")
+	if s == "" {
+		s = strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	}
+	if s == "" {
+		return authToken{}, false
+	}
+	tok, err := verifyToken(authcfg.secret, s)
+	if err != nil {
+		return authToken{}, false
+	}
+	return tok, true
+}
+
+func remoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// allowed reports whether r's remote IP is still within its rate budget,
+// lazily creating a token-bucket limiter per IP the first time it's seen.
+func allowed(r *http.Request) bool {
+	if authcfg.rate <= 0 {
+		return true
+	}
+	ip := remoteIP(r)
+	authcfg.mu.Lock()
+	lim, ok := authcfg.limiters[ip]
+	if !ok {
+		lim = rate.NewLimiter(rate.Limit(authcfg.rate/60), int(authcfg.rate))
+		authcfg.limiters[ip] = lim
+	}
+	authcfg.mu.Unlock()
+	return lim.Allow()
+}
+
+// chargeQuota charges slot against sub's quota of open slots, refusing once
+// maxSlotsPerSubject is reached.
+func chargeQuota(sub, slot string) bool {
+	authcfg.mu.Lock()
+	defer authcfg.mu.Unlock()
+	if authcfg.quota[sub] >= maxSlotsPerSubject {
+		return false
+	}
+	authcfg.quota[sub]++
+	authcfg.subjects[slot] = sub
+	return true
+}
+
+// releaseSlotQuota credits slot's charge back to whichever subject booked
+// it, if any. It's a no-op when auth is disabled or slot was never
+// charged, so callers can call it unconditionally when a slot is freed.
+func releaseSlotQuota(slot string) {
+	authcfg.mu.Lock()
+	defer authcfg.mu.Unlock()
+	sub, ok := authcfg.subjects[slot]
+	if !ok {
+		return
+	}
+	delete(authcfg.subjects, slot)
+	if authcfg.quota[sub] > 0 {
+		authcfg.quota[sub]--
+	}
+}
+
+// bookslot books a new slot and, if sub is non-empty, charges it against
+// the subject's quota of open slots.
+func bookslot(sub string) (slot string, ok bool) {
+	slot, ok = booknewslot()
+	if !ok {
+		return "", false
+	}
+	if sub != "" && !chargeQuota(sub, slot) {
+		store.Free(slot)
+		return "", false
+	}
+	return slot, true
+}
+
+// freeslot releases slot and credits back any quota it was charged
+// against.
+func freeslot(slot string) {
+	store.Free(slot)
+	releaseSlotQuota(slot)
+}
+
+// tokenHandler hands out a short-lived HMAC token authorising a slot
+// booking. It's meant to be called from behind an operator's own frontend,
+// e.g. after a login or a captcha, and is only registered when
+// -auth-secret is set.
+//
+// sub is always the caller's remote IP, never a client-supplied value:
+// the whole point of maxSlotsPerSubject is to bound how many open slots
+// one caller can sit on, and a caller-chosen sub would let anyone mint as
+// many distinct quotas as they like. An operator fronting this with real
+// accounts should charge quota against the authenticated account instead,
+// by having their frontend book slots on the account's behalf rather than
+// forwarding a sub here.
+func tokenHandler(w http.ResponseWriter, r *http.Request) {
+	if !allowed(r) {
+		http.Error(w, "rate limited", http.StatusTooManyRequests)
+		return
+	}
+	sub := remoteIP(r)
+	tok := authToken{
+		Exp: time.Now().Add(5 * time.Minute).Unix(),
+		Sub: sub,
+	}
+	s, err := signToken(authcfg.secret, tok)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Write([]byte(s))
+}
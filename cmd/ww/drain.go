@@ -0,0 +1,25 @@
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// draining is set once the server starts shutting down, after which new
+// slot bookings are refused with CloseNoMoreSlots while in-flight
+// rendezvous are left to finish on their own.
+var draining int32
+
+func isDraining() bool { return atomic.LoadInt32(&draining) == 1 }
+func startDraining()   { atomic.StoreInt32(&draining, 1) }
+
+// activeSessions counts relay, relaygroup and relaybytes websocket sessions
+// currently in flight. http.Server.Shutdown doesn't wait for hijacked
+// connections — and every one of these is hijacked, being a websocket — so
+// without this the -grace period server() promises on SIGTERM would be a
+// no-op: ListenAndServe would return as soon as Shutdown stops accepting new
+// conns, killing in-flight rendezvous instead of letting them drain.
+var activeSessions sync.WaitGroup
+
+func sessionStarted() { activeSessions.Add(1) }
+func sessionEnded()   { activeSessions.Done() }
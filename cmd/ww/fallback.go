@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// relayMode controls whether /t/ is available as a TURN-style fallback for
+// peers whose ICE negotiation fails.
+type relayMode int
+
+const (
+	relayOff relayMode = iota
+	relayOpportunistic
+	relayAlways
+)
+
+func parseRelayMode(s string) (relayMode, error) {
+	switch s {
+	case "off":
+		return relayOff, nil
+	case "opportunistic":
+		return relayOpportunistic, nil
+	case "always":
+		return relayAlways, nil
+	}
+	return relayOff, fmt.Errorf("invalid -relay mode %q, want off, opportunistic or always", s)
+}
+
+// relaycfg holds the fallback relay's runtime configuration, set from flags
+// in server().
+var relaycfg = struct {
+	mode  relayMode
+	quota int64 // bytes per slot, 0 means unlimited
+}{mode: relayOpportunistic}
+
+// relayUsage tracks bytes relayed per slot over /t/, shared between the two
+// peers' relaybytes calls for that slot so -relay-quota bounds the slot as
+// a whole, not each direction separately (which would let the pair move up
+// to 2x the configured quota between them).
+var relayUsage = struct {
+	mu    sync.Mutex
+	bytes map[string]int64
+}{bytes: make(map[string]int64)}
+
+// chargeRelayQuota adds n bytes to slot's running total and reports whether
+// it's still within relaycfg.quota. A quota of 0 means unlimited.
+func chargeRelayQuota(slot string, n int64) bool {
+	if relaycfg.quota <= 0 {
+		return true
+	}
+	relayUsage.mu.Lock()
+	defer relayUsage.mu.Unlock()
+	relayUsage.bytes[slot] += n
+	return relayUsage.bytes[slot] <= relaycfg.quota
+}
+
+// freeRelayQuota discards slot's usage counter once one side of its relay
+// session ends.
+func freeRelayQuota(slot string) {
+	relayUsage.mu.Lock()
+	delete(relayUsage.bytes, slot)
+	relayUsage.mu.Unlock()
+}
+
+// relaybytes implements /t/<slotkey>, a TURN-style fallback for peers whose
+// ICE negotiation fails: after both sides have completed the PAKE and SDP
+// exchange over /s/<slotkey>, they reconnect here under the same slotkey
+// and the signalling server relays frames between them directly, so a
+// transfer can continue without an external TURN server. The clients
+// decide when to fall back to this (on ICE failure, or always, depending
+// on their own -relay setting). Unlike /s/ there's no new booking to hand
+// out: the server pairs the first two connections to the same /t/ path
+// under its own "t:"-prefixed key, and does not check that the slotkey is
+// or was in use on /s/.
+func relaybytes(w http.ResponseWriter, r *http.Request) {
+	if relaycfg.mode == relayOff {
+		http.NotFound(w, r)
+		return
+	}
+
+	slotkey := "t:" + r.URL.Path[len("/t/"):]
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	sessionStarted()
+	defer sessionEnded()
+
+	ctx, cancel := context.WithTimeout(r.Context(), slotTimeout)
+	defer cancel()
+
+	// Whichever peer gets here first books the slot; the other claims it.
+	if !store.Book(slotkey) && !store.Claim(slotkey) {
+		conn.WriteControl(
+			websocket.CloseMessage,
+			websocket.FormatCloseMessage(CloseNoSuchSlot, "no such slot"),
+			time.Now().Add(10*time.Second),
+		)
+		conn.Close()
+		return
+	}
+
+	in, out, err := store.Rendezvous(ctx, slotkey)
+	if err != nil {
+		store.Free(slotkey)
+		conn.WriteControl(
+			websocket.CloseMessage,
+			websocket.FormatCloseMessage(CloseSlotTimedOut, "timed out"),
+			time.Now().Add(10*time.Second),
+		)
+		conn.Close()
+		return
+	}
+	log.Printf("%s relay", slotkey)
+	defer store.Free(slotkey)
+	defer freeRelayQuota(slotkey)
+
+	// conn.ReadMessage below blocks with no deadline of its own, so once
+	// rendezvous has happened, ctx expiring (slotTimeout) wouldn't
+	// otherwise end this handler until the peer next sent something;
+	// closing conn is what makes the timeout actually interrupt it, same
+	// as relaygroup does for the group path.
+	go func() {
+		<-ctx.Done()
+		conn.Close()
+	}()
+
+	var closeOnce sync.Once
+	closeSlow := func() { closeOnce.Do(func() { closeSlowPeer(conn) }) }
+
+	done := pumpIn(conn, in, ctx.Done(), closeSlow)
+
+	for {
+		messageType, p, err := conn.ReadMessage()
+		if err != nil {
+			break
+		}
+		metricRelayMessages.WithLabelValues("in").Inc()
+		metricRelayBytes.WithLabelValues("in").Add(float64(len(p)))
+		if !chargeRelayQuota(slotkey, int64(len(p))) {
+			log.Printf("%s relay quota exceeded", slotkey)
+			break
+		}
+		if !sendOut(out, Frame{Type: messageType, Data: p}, done) {
+			log.Printf("%s slow peer", slotkey)
+			closeSlow()
+			break
+		}
+	}
+	<-done
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// hub fans messages out between more than two peers sharing a single slot,
+// for group wormholes booked with ?n=<k>. Unlike the pairwise rendezvous in
+// SlotStore, membership and broadcast stay entirely in-process: group mode
+// isn't yet supported across a pool of signalling server instances.
+type hub struct {
+	mu      sync.RWMutex
+	members []*hubMember
+	n       int
+}
+
+// hubMember pumps broadcast frames to one group peer through its own
+// buffered outbox and goroutine, the same bounded-writer shape writer.go
+// gives the pairwise path: a slow member stalls only its own write, never
+// the broadcast loop or the other members', and join/leave only ever take
+// the hub lock, never a socket write, so they can't be starved by one.
+type hubMember struct {
+	conn      *websocket.Conn
+	out       chan Frame
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func newHubMember(conn *websocket.Conn) *hubMember {
+	m := &hubMember{conn: conn, out: make(chan Frame, outboxSize), done: make(chan struct{})}
+	go func() {
+		for {
+			select {
+			case f := <-m.out:
+				conn.SetWriteDeadline(time.Now().Add(writeDeadline))
+				if err := conn.WriteMessage(f.Type, f.Data); err != nil {
+					m.shutdown()
+					return
+				}
+			case <-m.done:
+				return
+			}
+		}
+	}()
+	return m
+}
+
+// shutdown closes conn and stops m's pump goroutine; it's safe to call more
+// than once, from broadcast (a member too slow to keep up) or leave (a
+// member that's gone) alike.
+func (m *hubMember) shutdown() {
+	m.closeOnce.Do(func() {
+		closeSlowPeer(m.conn)
+		close(m.done)
+	})
+}
+
+func newHub(n int) *hub {
+	return &hub{n: n}
+}
+
+// join adds conn to the hub, returning false if it's already full.
+func (h *hub) join(conn *websocket.Conn) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if len(h.members) >= h.n {
+		return false
+	}
+	h.members = append(h.members, newHubMember(conn))
+	return true
+}
+
+// leave removes conn from the hub, shutting down its member pump, and
+// reports how many members remain.
+func (h *hub) leave(conn *websocket.Conn) int {
+	h.mu.Lock()
+	var gone *hubMember
+	for i, m := range h.members {
+		if m.conn == conn {
+			h.members = append(h.members[:i], h.members[i+1:]...)
+			gone = m
+			break
+		}
+	}
+	remaining := len(h.members)
+	h.mu.Unlock()
+	// shutdown writes a close frame, so it runs outside the hub lock.
+	if gone != nil {
+		gone.shutdown()
+	}
+	return remaining
+}
+
+// broadcast enqueues a message for every member except from, each under its
+// own writeDeadline; a member that doesn't drain its outbox in time is
+// dropped from the hub as too slow to keep up, same as the pairwise relay.
+func (h *hub) broadcast(from *websocket.Conn, mt int, p []byte) {
+	h.mu.RLock()
+	members := append([]*hubMember(nil), h.members...)
+	h.mu.RUnlock()
+	for _, m := range members {
+		if m.conn == from {
+			continue
+		}
+		if !sendOut(m.out, Frame{Type: mt, Data: p}, m.done) {
+			log.Printf("slow group peer")
+			m.shutdown()
+		}
+	}
+}
+
+// groups holds the hubs for slots booked in group mode, keyed by slotkey.
+var groups = struct {
+	sync.Mutex
+	m map[string]*hub
+}{m: make(map[string]*hub)}
+
+// relaygroup runs the group-mode half of relay: it either creates a new hub
+// (the initiator, booking with ?n=<k>) or joins an existing one (every
+// subsequent member, visiting the plain /s/<slotkey> URL like a regular
+// pairwise join), then fans out whatever conn sends to the rest of the
+// hub until conn goes away.
+func relaygroup(r *http.Request, conn *websocket.Conn, slotkey string, n int, sub string) {
+	ctx, cancel := context.WithTimeout(r.Context(), slotTimeout)
+	defer cancel()
+
+	var h *hub
+	if n > 0 {
+		if isDraining() {
+			conn.WriteControl(
+				websocket.CloseMessage,
+				websocket.FormatCloseMessage(CloseNoMoreSlots, "server is shutting down"),
+				time.Now().Add(10*time.Second),
+			)
+			conn.Close()
+			return
+		}
+		// Initiator: book a slot and create its hub.
+		newslot, ok := bookslot(sub)
+		if !ok {
+			conn.WriteControl(
+				websocket.CloseMessage,
+				websocket.FormatCloseMessage(CloseNoMoreSlots, "cannot allocate slots"),
+				time.Now().Add(10*time.Second),
+			)
+			conn.Close()
+			return
+		}
+		slotkey = newslot
+		h = newHub(n)
+		groups.Lock()
+		groups.m[slotkey] = h
+		groups.Unlock()
+		metricSlotsActive.Inc()
+		h.join(conn)
+		log.Printf("%s book group of %d", slotkey, n)
+		if err := conn.WriteMessage(websocket.TextMessage, []byte(slotkey)); err != nil {
+			log.Println(err)
+			groups.Lock()
+			delete(groups.m, slotkey)
+			groups.Unlock()
+			metricSlotsActive.Dec()
+			freeslot(slotkey)
+			return
+		}
+	} else {
+		groups.Lock()
+		h = groups.m[slotkey]
+		groups.Unlock()
+		if h == nil || !h.join(conn) {
+			code := CloseNoSuchSlot
+			msg := "no such slot"
+			if h != nil {
+				code, msg = CloseSlotFull, "slot full"
+			}
+			conn.WriteControl(
+				websocket.CloseMessage,
+				websocket.FormatCloseMessage(code, msg),
+				time.Now().Add(10*time.Second),
+			)
+			conn.Close()
+			return
+		}
+		log.Printf("%s join group", slotkey)
+	}
+
+	defer func() {
+		if h.leave(conn) == 0 {
+			groups.Lock()
+			delete(groups.m, slotkey)
+			groups.Unlock()
+			metricSlotsActive.Dec()
+			freeslot(slotkey)
+		}
+	}()
+
+	// conn.ReadMessage below blocks with no deadline of its own, so ctx
+	// expiring (slotTimeout) wouldn't otherwise end this member's loop
+	// until it next happened to send something; closing conn is what
+	// makes the timeout actually interrupt it.
+	go func() {
+		<-ctx.Done()
+		conn.Close()
+	}()
+
+	for {
+		messageType, p, err := conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		h.broadcast(conn, messageType, p)
+	}
+}
+
+// parseGroupSize returns the group size requested by ?n=<k>, or 0 if the
+// query is absent or invalid, in which case the caller falls back to a
+// regular two-party slot.
+func parseGroupSize(r *http.Request) int {
+	n, err := strconv.Atoi(r.URL.Query().Get("n"))
+	if err != nil || n < 2 {
+		return 0
+	}
+	return n
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"log"
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var (
+	metricSlotsActive = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "slots_active",
+		Help: "Number of slots currently booked or rendezvousing.",
+	})
+	metricSlotsBooked = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "slots_booked_total",
+		Help: "Total number of slots booked.",
+	})
+	metricSlotsRendezvous = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "slots_rendezvous_total",
+		Help: "Total number of slots whose peer joined.",
+	})
+	metricSlotsTimeout = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "slots_timeout_total",
+		Help: "Total number of slots that timed out with no peer.",
+	})
+	metricSlotsRejected = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "slots_rejected_total",
+		Help: "Total number of rejected slot requests, by reason.",
+	}, []string{"reason"})
+	metricTimeToRendezvous = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "slots_time_to_rendezvous_seconds",
+		Help:    "Time between booking a slot and its peer joining.",
+		Buckets: prometheus.DefBuckets,
+	})
+	metricRelayBytes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "relay_bytes_total",
+		Help: "Total bytes relayed, by direction.",
+	}, []string{"direction"})
+	metricRelayMessages = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "relay_messages_total",
+		Help: "Total messages relayed, by direction.",
+	}, []string{"direction"})
+)
+
+// serveMetrics starts a /metrics endpoint on addr. It's meant to be bound
+// to a private interface via -metrics-addr, separately from the public
+// http/https listeners.
+func serveMetrics(addr string) *http.Server {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	srv := &http.Server{Addr: addr, Handler: mux}
+	go func() {
+		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Println(err)
+		}
+	}()
+	return srv
+}
@@ -11,9 +11,11 @@ import (
 	"math/rand"
 	"net/http"
 	"os"
+	"os/signal"
 	"strconv"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 
 	"github.com/NYTimes/gziphandler"
@@ -40,46 +42,61 @@ const (
 	CloseNoSuchSlot = 4000 + iota
 	CloseSlotTimedOut
 	CloseNoMoreSlots
+	CloseSlotFull
+	CloseSlowPeer
 )
 
-// slots is a map of allocated slot numbers.
-var slots = struct {
-	m map[string]chan *websocket.Conn
-	sync.RWMutex
-}{m: make(map[string]chan *websocket.Conn)}
+// ttySubprotocol is offered during the websocket upgrade by `ww tty`
+// sessions, which carry a framed pty stream over the DataChannel instead
+// of the usual file/text transfer. The relay never looks at the payload
+// either way, so this doesn't change how slots are booked or piped
+// together; it just lets operators tell the two kinds of session apart
+// in logs.
+const ttySubprotocol = "webwormhole-tty"
 
-// freeslot tries to find an available numeric slot, favouring smaller numbers.
-// This assume slots is locked.
-func freeslot() (slot string, ok bool) {
+// store holds the rendezvous state for every slot. It defaults to an
+// in-process store, but can be swapped for a Redis-backed one so that
+// multiple signalling server instances behind a load balancer can pair up
+// peers that land on different processes. See SlotStore.
+var store SlotStore = newLocalSlotStore()
+
+// booknewslot tries to book an available numeric slot, favouring smaller
+// numbers.
+func booknewslot() (slot string, ok bool) {
 	// Try a single decimal digit number.
 	for i := 0; i < 3; i++ {
 		s := strconv.Itoa(rand.Intn(10))
-		if _, ok := slots.m[s]; !ok {
+		if store.Book(s) {
+			metricSlotsBooked.Inc()
 			return s, true
 		}
 	}
 	// Try a single byte number.
 	for i := 0; i < 64; i++ {
 		s := strconv.Itoa(rand.Intn(1 << 8))
-		if _, ok := slots.m[s]; !ok {
+		if store.Book(s) {
+			metricSlotsBooked.Inc()
 			return s, true
 		}
 	}
 	// Try a 2-byte number.
 	for i := 0; i < 1024; i++ {
 		s := strconv.Itoa(rand.Intn(1 << 16))
-		if _, ok := slots.m[s]; !ok {
+		if store.Book(s) {
+			metricSlotsBooked.Inc()
 			return s, true
 		}
 	}
 	// Try a 3-byte number.
 	for i := 0; i < 1024; i++ {
 		s := strconv.Itoa(rand.Intn(1 << 24))
-		if _, ok := slots.m[s]; !ok {
+		if store.Book(s) {
+			metricSlotsBooked.Inc()
 			return s, true
 		}
 	}
 	// Give up.
+	metricSlotsRejected.WithLabelValues("no_capacity").Inc()
 	return "", false
 }
 
@@ -88,110 +105,165 @@ var upgrader = websocket.Upgrader{
 	ReadBufferSize:  1 << 10,
 	WriteBufferSize: 1 << 10,
 	CheckOrigin:     func(*http.Request) bool { return true },
+	// EnableCompression turns on permessage-deflate; it's set from the
+	// -compress flag in server(), which defaults it to true.
+	// Subprotocols lets gorilla/websocket echo back whichever of these the
+	// client asked for, so conn.Subprotocol() reports it after Upgrade.
+	Subprotocols: []string{ttySubprotocol},
 }
 
-// relay sets up a rendezvous on a slot and pipes the two websockets together.
+// relay sets up a rendezvous on a slot and pipes the two websockets
+// together, possibly via store, which may be relaying frames to and from
+// another signalling server instance. Slots booked with ?n=<k>, and any
+// later joins to them, are handed off to relaygroup instead.
+//
+// When -auth-secret is set, every /s/ request requires a valid HMAC token
+// (see authenticate) and booked slots are quota tracked per subject.
+// Independently of that, -rate limits /s/ requests per remote IP; see
+// auth.go.
 func relay(w http.ResponseWriter, r *http.Request) {
 	slotkey := r.URL.Path[len("/s/"):]
-	var rconn *websocket.Conn
+
+	tok, ok := authenticate(r)
+	if !ok || (tok.Slot != "" && tok.Slot != slotkey) {
+		metricSlotsRejected.WithLabelValues("unauthorized").Inc()
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if !allowed(r) {
+		metricSlotsRejected.WithLabelValues("rate_limited").Inc()
+		http.Error(w, "rate limited", http.StatusTooManyRequests)
+		return
+	}
 	conn, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
 		log.Println(err)
 		return
 	}
+	if conn.Subprotocol() == ttySubprotocol {
+		log.Printf("%s tty", slotkey)
+	}
+	if slotkey == "" && isDraining() {
+		metricSlotsRejected.WithLabelValues("draining").Inc()
+		conn.WriteControl(
+			websocket.CloseMessage,
+			websocket.FormatCloseMessage(CloseNoMoreSlots, "server is shutting down"),
+			time.Now().Add(10*time.Second),
+		)
+		conn.Close()
+		return
+	}
 
-	ctx, cancel := context.WithTimeout(r.Context(), slotTimeout)
+	sessionStarted()
+	defer sessionEnded()
 
-	go func() {
-		if slotkey == "" {
-			// Book a new slot.
-			slots.Lock()
-			newslot, ok := freeslot()
-			if !ok {
-				slots.Unlock()
-				conn.WriteControl(
-					websocket.CloseMessage,
-					websocket.FormatCloseMessage(CloseNoMoreSlots, "cannot allocate slots"),
-					time.Now().Add(10*time.Second),
-				)
-				conn.Close()
-				return
-			}
-			slotkey = newslot
-			sc := make(chan *websocket.Conn)
-			slots.m[slotkey] = sc
-			slots.Unlock()
-			log.Printf("%s book", slotkey)
-			err = conn.WriteMessage(websocket.TextMessage, []byte(slotkey))
-			if err != nil {
-				log.Println(err)
-				return
-			}
-			select {
-			case <-ctx.Done():
-				log.Printf("%s timeout", slotkey)
-				slots.Lock()
-				delete(slots.m, slotkey)
-				slots.Unlock()
-				conn.WriteControl(
-					websocket.CloseMessage,
-					websocket.FormatCloseMessage(CloseSlotTimedOut, "timed out"),
-					time.Now().Add(10*time.Second),
-				)
-				conn.Close()
-				return
-			case sc <- conn:
-			}
-			rconn = <-sc
-			log.Printf("%s rendezvous", slotkey)
+	if n := parseGroupSize(r); slotkey == "" && n > 0 {
+		relaygroup(r, conn, "", n, tok.Sub)
+		return
+	}
+	if slotkey != "" {
+		groups.Lock()
+		_, isGroup := groups.m[slotkey]
+		groups.Unlock()
+		if isGroup {
+			relaygroup(r, conn, slotkey, 0, tok.Sub)
 			return
 		}
-		// Join an existing slot.
-		slots.Lock()
-		sc, ok := slots.m[slotkey]
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), slotTimeout)
+	defer cancel()
+
+	var bookedAt time.Time
+	if slotkey == "" {
+		// Book a new slot.
+		newslot, ok := bookslot(tok.Sub)
 		if !ok {
-			slots.Unlock()
 			conn.WriteControl(
 				websocket.CloseMessage,
-				websocket.FormatCloseMessage(CloseNoSuchSlot, "no such slot"),
+				websocket.FormatCloseMessage(CloseNoMoreSlots, "cannot allocate slots"),
 				time.Now().Add(10*time.Second),
 			)
 			conn.Close()
 			return
 		}
-		delete(slots.m, slotkey)
-		slots.Unlock()
-		log.Printf("%s visit", slotkey)
-		select {
-		case <-ctx.Done():
+		slotkey = newslot
+		bookedAt = time.Now()
+		log.Printf("%s book", slotkey)
+		if err := conn.WriteMessage(websocket.TextMessage, []byte(slotkey)); err != nil {
+			log.Println(err)
+			freeslot(slotkey)
+			return
+		}
+	} else {
+		// Join an existing slot.
+		if !store.Claim(slotkey) {
+			metricSlotsRejected.WithLabelValues("no_such_slot").Inc()
 			conn.WriteControl(
 				websocket.CloseMessage,
-				websocket.FormatCloseMessage(CloseSlotTimedOut, "timed out"),
+				websocket.FormatCloseMessage(CloseNoSuchSlot, "no such slot"),
 				time.Now().Add(10*time.Second),
 			)
 			conn.Close()
-		case rconn = <-sc:
+			return
 		}
-		sc <- conn
+		log.Printf("%s visit", slotkey)
+	}
+
+	if !bookedAt.IsZero() {
+		// Count the slot once, on the booking peer's side.
+		metricSlotsActive.Inc()
+		defer metricSlotsActive.Dec()
+	}
+
+	in, out, err := store.Rendezvous(ctx, slotkey)
+	if err != nil {
+		metricSlotsTimeout.Inc()
+		log.Printf("%s timeout", slotkey)
+		freeslot(slotkey)
+		conn.WriteControl(
+			websocket.CloseMessage,
+			websocket.FormatCloseMessage(CloseSlotTimedOut, "timed out"),
+			time.Now().Add(10*time.Second),
+		)
+		conn.Close()
+		return
+	}
+	metricSlotsRendezvous.Inc()
+	if !bookedAt.IsZero() {
+		metricTimeToRendezvous.Observe(time.Since(bookedAt).Seconds())
+	}
+	log.Printf("%s rendezvous", slotkey)
+	defer freeslot(slotkey)
+
+	// conn.ReadMessage below blocks with no deadline of its own, so once
+	// rendezvous has happened, ctx expiring (slotTimeout) wouldn't
+	// otherwise end this handler until the peer next sent something;
+	// closing conn is what makes the timeout actually interrupt it, same
+	// as relaygroup does for the group path.
+	go func() {
+		<-ctx.Done()
+		conn.Close()
 	}()
 
-	defer cancel()
+	var closeOnce sync.Once
+	closeSlow := func() { closeOnce.Do(func() { closeSlowPeer(conn) }) }
+
+	done := pumpIn(conn, in, ctx.Done(), closeSlow)
 	for {
 		messageType, p, err := conn.ReadMessage()
 		if err != nil {
-			return
-		}
-		if rconn == nil {
-			// We could synchronise with the rendezvous goroutine above and wait for
-			// B to connect, but receiving anything at this stage is a protocol violation
-			// so we should just bail out.
-			return
+			break
 		}
-		err = rconn.WriteMessage(messageType, p)
-		if err != nil {
-			return
+		metricRelayMessages.WithLabelValues("in").Inc()
+		metricRelayBytes.WithLabelValues("in").Add(float64(len(p)))
+		if !sendOut(out, Frame{Type: messageType, Data: p}, done) {
+			log.Printf("%s slow peer", slotkey)
+			closeSlow()
+			break
 		}
 	}
+	<-done
 }
 
 func server(args ...string) {
@@ -209,11 +281,44 @@ func server(args ...string) {
 	whitelist := set.String("hosts", "", "comma separated list of hosts for which to request let's encrypt certs")
 	secretpath := set.String("secrets", os.Getenv("HOME")+"/keys", "path to put let's encrypt cache")
 	html := set.String("ui", "./web", "path to the web interface files")
+	redisaddr := set.String("redis", "", "redis address for a shared SlotStore, for running multiple instances behind a load balancer (default: in-process store)")
+	relaymode := set.String("relay", "opportunistic", "TURN-style fallback relay mode for peers whose ICE negotiation fails: off, opportunistic or always")
+	relayquota := set.Int64("relay-quota", 0, "maximum bytes to relay per slot over /t/, 0 means unlimited")
+	authsecret := set.String("auth-secret", "", "secret to sign and verify slot booking tokens with; when set, /s/ requires one (see /token)")
+	rateperip := set.Float64("rate", 0, "max requests per minute per remote IP for booking a slot and for /token, 0 disables rate limiting")
+	compress := set.Bool("compress", true, "enable permessage-deflate websocket compression; disable on constrained hardware")
+	metricsaddr := set.String("metrics-addr", "", "address to serve Prometheus /metrics on, e.g. a private interface; empty disables metrics")
+	grace := set.Duration("grace", 30*time.Second, "how long to let in-flight rendezvous drain after SIGTERM before shutting down")
 	set.Parse(args[1:])
 
+	upgrader.EnableCompression = *compress
+
+	if *redisaddr != "" {
+		store = newRedisSlotStore(*redisaddr)
+	}
+	mode, err := parseRelayMode(*relaymode)
+	if err != nil {
+		fmt.Fprintln(set.Output(), err)
+		os.Exit(2)
+	}
+	relaycfg.mode = mode
+	relaycfg.quota = *relayquota
+	if *authsecret != "" {
+		authcfg.secret = []byte(*authsecret)
+	}
+	authcfg.rate = *rateperip
+
+	if *metricsaddr != "" {
+		serveMetrics(*metricsaddr)
+	}
+
 	fs := gziphandler.GzipHandler(http.FileServer(http.Dir(*html)))
 	mux := http.NewServeMux()
 	mux.HandleFunc("/s/", relay)
+	mux.HandleFunc("/t/", relaybytes)
+	if authcfg.secret != nil {
+		mux.HandleFunc("/token", tokenHandler)
+	}
 	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("X-Version", protocolVersion)
 		if r.URL.Query().Get("go-get") == "1" || r.URL.Path == "/cmd/ww" {
@@ -244,9 +349,49 @@ func server(args ...string) {
 		Handler:      m.HTTPHandler(mux),
 	}
 
+	sigch := make(chan os.Signal, 1)
+	signal.Notify(sigch, syscall.SIGTERM)
+	shutdownDone := make(chan struct{})
+	go func() {
+		defer close(shutdownDone)
+		<-sigch
+		log.Printf("received SIGTERM, draining for up to %s", *grace)
+		startDraining()
+		ctx, cancel := context.WithTimeout(context.Background(), *grace)
+		defer cancel()
+		ssrv.Shutdown(ctx)
+		srv.Shutdown(ctx)
+
+		// Shutdown above only stops accepting new conns and returns once
+		// the listeners are closed; it doesn't wait for relay/relaygroup/
+		// relaybytes, since those are all hijacked websockets. Wait for
+		// activeSessions too, bounded by the same ctx, so -grace actually
+		// gives in-flight rendezvous a chance to finish instead of dying
+		// the moment ListenAndServe returns.
+		drained := make(chan struct{})
+		go func() {
+			activeSessions.Wait()
+			close(drained)
+		}()
+		select {
+		case <-drained:
+		case <-ctx.Done():
+			log.Printf("grace period elapsed with sessions still active, exiting anyway")
+		}
+	}()
+
 	if *httpsaddr != "" {
 		srv.Handler = m.HTTPHandler(nil) // Enable redirect to https handler.
-		go func() { log.Fatal(ssrv.ListenAndServeTLS("", "")) }()
+		go func() {
+			if err := ssrv.ListenAndServeTLS("", ""); err != nil && err != http.ErrServerClosed {
+				log.Fatal(err)
+			}
+		}()
+	}
+	if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		log.Fatal(err)
 	}
-	log.Fatal(srv.ListenAndServe())
+	// ListenAndServe returns as soon as Shutdown is called; wait for the
+	// drain above to finish before returning.
+	<-shutdownDone
 }
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Frame is a single WebSocket message relayed between the two peers on a
+// slot.
+type Frame struct {
+	Type int
+	Data []byte
+}
+
+// SlotStore arbitrates slot bookings and rendezvous. It lets the rendezvous
+// state that used to live in the package-level slots map be shared across a
+// pool of signalling server processes sitting behind a load balancer,
+// instead of requiring both peers to land on the same one.
+//
+// localSlotStore is the zero-configuration default, and only pairs peers
+// that happen to hit the same process. redisSlotStore extends this to a
+// pool of processes sharing a Redis instance.
+type SlotStore interface {
+	// Book reserves slot for slotTimeout, returning false if it is already
+	// taken.
+	Book(slot string) bool
+
+	// Free releases a slot that was booked but never joined, or whose
+	// rendezvous has finished.
+	Free(slot string)
+
+	// Claim atomically consumes an existing booking, returning false if
+	// slot was never booked or has already been claimed. Unlike Book,
+	// which fails on a slot that's already taken, Claim fails on one
+	// that isn't: it's how the second peer takes over the reservation
+	// the first peer made.
+	Claim(slot string) bool
+
+	// Rendezvous blocks until a peer joins slot, or ctx is done, and
+	// returns a channel of frames coming from that peer plus a channel to
+	// send frames to it. The peer may be connected to this process or
+	// another one sharing the same store.
+	Rendezvous(ctx context.Context, slot string) (in <-chan Frame, out chan<- Frame, err error)
+}
+
+// localSlotStore is an in-process SlotStore. It is equivalent to the
+// original slots map, just reshaped behind the SlotStore interface.
+type localSlotStore struct {
+	mu      sync.Mutex
+	booked  map[string]struct{}
+	waiting map[string]*localRendezvous
+	active  map[string]*localRendezvous
+}
+
+// outboxSize bounds how many frames may be queued for a peer before
+// relay considers it too slow to keep relaying to; see writer.go.
+const outboxSize = 64
+
+type localRendezvous struct {
+	ready    chan struct{}
+	toFirst  chan Frame
+	toSecond chan Frame
+}
+
+func newLocalSlotStore() *localSlotStore {
+	return &localSlotStore{
+		booked:  make(map[string]struct{}),
+		waiting: make(map[string]*localRendezvous),
+		active:  make(map[string]*localRendezvous),
+	}
+}
+
+func (s *localSlotStore) Book(slot string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.booked[slot]; ok {
+		return false
+	}
+	s.booked[slot] = struct{}{}
+	return true
+}
+
+func (s *localSlotStore) Free(slot string) {
+	s.mu.Lock()
+	delete(s.booked, slot)
+	delete(s.waiting, slot)
+	delete(s.active, slot)
+	s.mu.Unlock()
+}
+
+func (s *localSlotStore) Claim(slot string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.booked[slot]; !ok {
+		return false
+	}
+	delete(s.booked, slot)
+	return true
+}
+
+func (s *localSlotStore) Rendezvous(ctx context.Context, slot string) (<-chan Frame, chan<- Frame, error) {
+	s.mu.Lock()
+	rv, ok := s.waiting[slot]
+	if !ok {
+		// We're first in: leave a rendezvous behind for the second peer
+		// and wait for it to show up. The channels are buffered so that a
+		// burst of frames from one peer doesn't have to wait, one at a
+		// time, for the other to drain them; see the writer goroutine in
+		// relay that does the draining.
+		rv = &localRendezvous{
+			ready:    make(chan struct{}),
+			toFirst:  make(chan Frame, outboxSize),
+			toSecond: make(chan Frame, outboxSize),
+		}
+		s.waiting[slot] = rv
+		s.mu.Unlock()
+		select {
+		case <-ctx.Done():
+			s.mu.Lock()
+			if s.waiting[slot] == rv {
+				delete(s.waiting, slot)
+			}
+			s.mu.Unlock()
+			return nil, nil, ctx.Err()
+		case <-rv.ready:
+			s.mu.Lock()
+			s.active[slot] = rv
+			s.mu.Unlock()
+			return rv.toFirst, rv.toSecond, nil
+		}
+	}
+	// We're second: the rendezvous is ready, wake up whoever is waiting.
+	delete(s.waiting, slot)
+	s.active[slot] = rv
+	s.mu.Unlock()
+	close(rv.ready)
+	return rv.toSecond, rv.toFirst, nil
+}
+
+// Book does not itself expire slots: relay is responsible for calling Free
+// once slotTimeout elapses with no rendezvous. redisSlotStore additionally
+// relies on the booking key's Redis TTL as a backstop against a process
+// dying before it can call Free.
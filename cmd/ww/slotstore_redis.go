@@ -0,0 +1,285 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// redisBookScript atomically reserves a slot key with a TTL, mirroring
+// localSlotStore.Book: it only succeeds if the key does not already exist.
+// SETNX plus a separate EXPIRE would leave a window where a crash between
+// the two calls books the slot forever, so this does both in one round
+// trip.
+const redisBookScript = `
+if redis.call("SETNX", KEYS[1], ARGV[1]) == 1 then
+	redis.call("EXPIRE", KEYS[1], ARGV[2])
+	return 1
+end
+return 0
+`
+
+// redisClaimScript atomically consumes an existing booking, mirroring
+// localSlotStore.Claim: it's how the second peer takes over a reservation
+// the first peer made, without a third peer racing in on the same key.
+const redisClaimScript = `
+if redis.call("EXISTS", KEYS[1]) == 1 then
+	redis.call("DEL", KEYS[1])
+	return 1
+end
+return 0
+`
+
+// redisFrame is the wire format published on a slot's Redis channel.
+// Conn identifies the Rendezvous call that published this frame, so that
+// call can ignore its own echoes. It has to be per-connection rather than
+// per-process: two peers of the same slot land on the same signalling
+// process whenever there's only one (or by chance behind a load
+// balancer), and a process-wide id can't tell them apart.
+type redisFrame struct {
+	Conn string `json:"c"`
+	Type int    `json:"t"`
+	Data []byte `json:"d"`
+}
+
+// redisSlotStore is a SlotStore backed by Redis, so that a pool of
+// signalling processes behind a load balancer can share rendezvous state.
+// Slot reservation uses SETNX plus a TTL (redisBookScript); frames between
+// peers that land on different processes are relayed over a per-slot
+// pub/sub channel.
+type redisSlotStore struct {
+	pool     *redis.Pool
+	instance string // random id identifying this process, used as a prefix for connIDs
+	connSeq  uint64 // atomically incremented to make each Rendezvous call's connID unique
+	book     *redis.Script
+	claim    *redis.Script
+
+	mu   sync.Mutex
+	subs map[string]*redisSub
+}
+
+// nextConnID returns an id unique to one Rendezvous call, so that two
+// peers of the same slot sharing this process still tag their frames
+// distinctly. See redisFrame.
+func (s *redisSlotStore) nextConnID() string {
+	return fmt.Sprintf("%s-%d", s.instance, atomic.AddUint64(&s.connSeq, 1))
+}
+
+type redisSub struct {
+	done chan struct{}
+}
+
+func newRedisSlotStore(addr string) *redisSlotStore {
+	hostname, _ := os.Hostname()
+	return &redisSlotStore{
+		pool: &redis.Pool{
+			Dial: func() (redis.Conn, error) { return redis.Dial("tcp", addr) },
+		},
+		instance: fmt.Sprintf("%s-%d", hostname, os.Getpid()),
+		book:     redis.NewScript(1, redisBookScript),
+		claim:    redis.NewScript(1, redisClaimScript),
+		subs:     make(map[string]*redisSub),
+	}
+}
+
+func (s *redisSlotStore) slotkey(slot string) string      { return "ww:slot:" + slot }
+func (s *redisSlotStore) channel(slot string) string      { return "ww:slot:" + slot + ":relay" }
+func (s *redisSlotStore) announceChan(slot string) string { return "ww:slot:" + slot + ":announce" }
+func (s *redisSlotStore) ttlSeconds() int                 { return int(slotTimeout / time.Second) }
+
+// announceInterval is how often Rendezvous re-publishes its announce while
+// waiting for the peer's, so the handshake isn't lost if one side
+// subscribes a moment after the other's first publish.
+const announceInterval = 200 * time.Millisecond
+
+func (s *redisSlotStore) Book(slot string) bool {
+	conn := s.pool.Get()
+	defer conn.Close()
+	n, err := redis.Int(s.book.Do(conn, s.slotkey(slot), s.instance, s.ttlSeconds()))
+	if err != nil {
+		return false
+	}
+	return n == 1
+}
+
+func (s *redisSlotStore) Claim(slot string) bool {
+	conn := s.pool.Get()
+	defer conn.Close()
+	n, err := redis.Int(s.claim.Do(conn, s.slotkey(slot)))
+	if err != nil {
+		return false
+	}
+	return n == 1
+}
+
+func (s *redisSlotStore) Free(slot string) {
+	conn := s.pool.Get()
+	defer conn.Close()
+	conn.Do("DEL", s.slotkey(slot))
+
+	s.mu.Lock()
+	if sub, ok := s.subs[slot]; ok {
+		delete(s.subs, slot)
+		close(sub.done)
+	}
+	s.mu.Unlock()
+}
+
+// Rendezvous subscribes to the slot's relay and announce channels, then
+// blocks exchanging announces with the peer before returning, so neither
+// side starts publishing relay frames before the other has subscribed
+// to receive them (pub/sub is fire-and-forget: a publish with nobody
+// subscribed yet is simply dropped). Once paired, both peers publish every
+// frame to the same relay channel tagged with this call's connID, so each
+// side's reader goroutine just drops frames carrying its own connID (its
+// own echoes) and forwards the rest.
+func (s *redisSlotStore) Rendezvous(ctx context.Context, slot string) (<-chan Frame, chan<- Frame, error) {
+	connID := s.nextConnID()
+	conn := s.pool.Get()
+	psc := redis.PubSubConn{Conn: conn}
+	relayChan := s.channel(slot)
+	announceChan := s.announceChan(slot)
+	if err := psc.Subscribe(relayChan, announceChan); err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+
+	done := make(chan struct{})
+	s.mu.Lock()
+	s.subs[slot] = &redisSub{done: done}
+	s.mu.Unlock()
+
+	// psc.Receive() below blocks on the underlying connection with no
+	// timeout of its own; closing conn is the only way to unblock it, so
+	// this is what makes Free (closing done) and ctx actually interrupt a
+	// pending Rendezvous instead of leaking the reader goroutine forever.
+	go func() {
+		select {
+		case <-done:
+		case <-ctx.Done():
+		}
+		conn.Close()
+	}()
+
+	relayMsgs := make(chan redis.Message)
+	announced := make(chan struct{})
+	recvErr := make(chan error, 1)
+	go func() {
+		defer psc.Close()
+		var once sync.Once
+		for {
+			switch v := psc.Receive().(type) {
+			case redis.Message:
+				if v.Channel == announceChan {
+					var f redisFrame
+					if err := json.Unmarshal(v.Data, &f); err == nil && f.Conn != connID {
+						once.Do(func() { close(announced) })
+					}
+					continue
+				}
+				select {
+				case relayMsgs <- v:
+				case <-done:
+					return
+				case <-ctx.Done():
+					return
+				}
+			case error:
+				select {
+				case recvErr <- v:
+				default:
+				}
+				return
+			}
+		}
+	}()
+
+	if err := s.announceAndWait(ctx, announceChan, connID, announced, recvErr); err != nil {
+		return nil, nil, err
+	}
+
+	in := make(chan Frame)
+	out := make(chan Frame)
+
+	go func() {
+		defer close(in)
+		for {
+			select {
+			case v, ok := <-relayMsgs:
+				if !ok {
+					return
+				}
+				var f redisFrame
+				if err := json.Unmarshal(v.Data, &f); err != nil || f.Conn == connID {
+					continue
+				}
+				select {
+				case in <- Frame{Type: f.Type, Data: f.Data}:
+				case <-done:
+					return
+				case <-ctx.Done():
+					return
+				}
+			case <-recvErr:
+				return
+			case <-done:
+				return
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	go func() {
+		publishConn := s.pool.Get()
+		defer publishConn.Close()
+		for {
+			select {
+			case f, ok := <-out:
+				if !ok {
+					return
+				}
+				b, _ := json.Marshal(redisFrame{Conn: connID, Type: f.Type, Data: f.Data})
+				publishConn.Do("PUBLISH", relayChan, b)
+			case <-done:
+				return
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return in, out, nil
+}
+
+// announceAndWait re-publishes this connID's announce on announceChan
+// every announceInterval until announced is closed (the peer's own
+// announce was seen), ctx is done, or the subscription errors out.
+func (s *redisSlotStore) announceAndWait(ctx context.Context, announceChan, connID string, announced <-chan struct{}, recvErr <-chan error) error {
+	publishConn := s.pool.Get()
+	defer publishConn.Close()
+
+	msg, _ := json.Marshal(redisFrame{Conn: connID})
+	publishConn.Do("PUBLISH", announceChan, msg)
+
+	ticker := time.NewTicker(announceInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-announced:
+			return nil
+		case <-ticker.C:
+			publishConn.Do("PUBLISH", announceChan, msg)
+		case err := <-recvErr:
+			return err
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
@@ -0,0 +1,275 @@
+package main
+
+// `ww tty` shares an interactive shell through a wormhole, tty-share style:
+// the host spawns $SHELL under a pty and streams it to whoever joins with
+// the resulting code, end-to-end encrypted over the same PAKE+DataChannel
+// path as `ww send`/`ww receive`. See readTTYFrame and writeTTYFrame for
+// the wire format.
+
+import (
+	"context"
+	"encoding/binary"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"os/signal"
+	"syscall"
+
+	"github.com/creack/pty"
+	"golang.org/x/term"
+
+	"webwormhole.io"
+)
+
+// ttyFrame types. Each frame on the DataChannel is a one byte type, a four
+// byte big-endian payload length, then the type-specific payload; see
+// readTTYFrame and writeTTYFrame.
+const (
+	ttyData ttyFrameType = iota
+	ttyResize
+	ttyExit
+)
+
+type ttyFrameType byte
+
+// maxTTYFrame bounds a frame's payload length. It's far above the 32 KiB
+// chunks either side actually writes, just enough that a peer can't use
+// the length prefix to make us allocate an arbitrary amount of memory.
+const maxTTYFrame = 1 << 20 // 1 MiB
+
+// readTTYFrame reads one frame from r, returning its type and payload.
+func readTTYFrame(r io.Reader) (ttyFrameType, []byte, error) {
+	var hdr [5]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return 0, nil, err
+	}
+	n := binary.BigEndian.Uint32(hdr[1:])
+	if n > maxTTYFrame {
+		return 0, nil, fmt.Errorf("tty frame too large: %d bytes", n)
+	}
+	payload := make([]byte, n)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return 0, nil, err
+	}
+	return ttyFrameType(hdr[0]), payload, nil
+}
+
+// writeTTYFrame writes one frame of typ carrying payload to w.
+func writeTTYFrame(w io.Writer, typ ttyFrameType, payload []byte) error {
+	hdr := make([]byte, 5, 5+len(payload))
+	hdr[0] = byte(typ)
+	binary.BigEndian.PutUint32(hdr[1:], uint32(len(payload)))
+	_, err := w.Write(append(hdr, payload...))
+	return err
+}
+
+func encodeResize(cols, rows uint16) []byte {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint16(b[0:], cols)
+	binary.BigEndian.PutUint16(b[2:], rows)
+	return b
+}
+
+func decodeResize(b []byte) (cols, rows uint16, err error) {
+	if len(b) < 4 {
+		return 0, 0, fmt.Errorf("short resize frame: %d bytes", len(b))
+	}
+	return binary.BigEndian.Uint16(b[0:]), binary.BigEndian.Uint16(b[2:]), nil
+}
+
+func tty(args ...string) {
+	set := flag.NewFlagSet(args[0], flag.ExitOnError)
+	set.Usage = func() {
+		fmt.Fprintf(set.Output(), "share or join an interactive shell over a wormhole\n\n")
+		fmt.Fprintf(set.Output(), "usage: %s %s [code]\n\n", os.Args[0], args[0])
+		fmt.Fprintf(set.Output(), "with no code, spawns $SHELL and shares it under a new code.\n")
+		fmt.Fprintf(set.Output(), "with a code, joins someone else's shared shell.\n\n")
+		fmt.Fprintf(set.Output(), "flags:\n")
+		set.PrintDefaults()
+	}
+	shell := set.String("shell", os.Getenv("SHELL"), "shell to spawn when hosting")
+	signalAddr := set.String("signal", "wss://webwormhole.io", "signalling server to rendezvous through")
+	set.Parse(args[1:])
+
+	var code string
+	if set.NArg() > 0 {
+		code = set.Arg(0)
+	}
+
+	ctx := context.Background()
+	c := wormhole.New(wormhole.WithSignal(*signalAddr), wormhole.WithSubprotocol(ttySubprotocol))
+	if code == "" {
+		newcode, err := c.Dial(ctx, "")
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Fprintf(os.Stderr, "code is: %s\n", newcode)
+		runHost(c, *shell)
+		return
+	}
+	if _, err := c.Dial(ctx, code); err != nil {
+		log.Fatal(err)
+	}
+	runGuest(c)
+}
+
+// runHost spawns shell under a pty and streams it over conn until either
+// the shell exits or the guest goes away, then sends an Exit frame with the
+// shell's exit code. It's the host half of `ww tty`.
+func runHost(conn io.ReadWriteCloser, shell string) {
+	if shell == "" {
+		shell = "/bin/sh"
+	}
+	cmd := exec.Command(shell)
+	ptmx, err := pty.Start(cmd)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	winch := make(chan os.Signal, 1)
+	signal.Notify(winch, syscall.SIGWINCH)
+	go func() {
+		for range winch {
+			if size, err := pty.GetsizeFull(os.Stdin); err == nil {
+				pty.Setsize(ptmx, size)
+			}
+		}
+	}()
+	winch <- syscall.SIGWINCH // apply the host terminal's initial size to the pty.
+
+	// shellDone is closed once the pty hits EOF, i.e. the shell exited.
+	shellDone := make(chan struct{})
+	go func() {
+		defer close(shellDone)
+		var buf [32 * 1024]byte
+		for {
+			n, err := ptmx.Read(buf[:])
+			if n > 0 {
+				if writeTTYFrame(conn, ttyData, buf[:n]) != nil {
+					return
+				}
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	readErr := make(chan error, 1)
+	go func() {
+		for {
+			typ, payload, err := readTTYFrame(conn)
+			if err != nil {
+				readErr <- err
+				return
+			}
+			switch typ {
+			case ttyData:
+				ptmx.Write(payload)
+			case ttyResize:
+				cols, rows, err := decodeResize(payload)
+				if err != nil {
+					log.Println(err)
+					continue
+				}
+				pty.Setsize(ptmx, &pty.Winsize{Cols: cols, Rows: rows})
+			}
+		}
+	}()
+
+	// Either the shell exiting or the guest going away ends the session.
+	// Whichever happens first, close ptmx so the shell is actually torn
+	// down (it gets a SIGHUP) before we wait on it and send the Exit
+	// frame, instead of leaving cmd.Wait() blocked on a shell the guest
+	// has already disconnected from.
+	select {
+	case <-shellDone:
+	case <-readErr:
+	}
+	ptmx.Close()
+
+	var code int
+	if err := cmd.Wait(); err != nil {
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			code = exitErr.ExitCode()
+		} else {
+			code = 1
+		}
+	}
+	writeTTYFrame(conn, ttyExit, encodeExit(code))
+	conn.Close()
+}
+
+// runGuest puts the local terminal in raw mode and forwards it to conn,
+// rendering whatever the host's shell writes back. It's the guest half of
+// `ww tty`.
+func runGuest(conn io.ReadWriteCloser) {
+	oldState, err := term.MakeRaw(int(os.Stdin.Fd()))
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer term.Restore(int(os.Stdin.Fd()), oldState)
+
+	winch := make(chan os.Signal, 1)
+	signal.Notify(winch, syscall.SIGWINCH)
+	go func() {
+		for range winch {
+			cols, rows, err := term.GetSize(int(os.Stdin.Fd()))
+			if err != nil {
+				continue
+			}
+			writeTTYFrame(conn, ttyResize, encodeResize(uint16(cols), uint16(rows)))
+		}
+	}()
+	winch <- syscall.SIGWINCH
+
+	go func() {
+		buf := make([]byte, 32*1024)
+		for {
+			n, err := os.Stdin.Read(buf)
+			if n > 0 {
+				if writeTTYFrame(conn, ttyData, buf[:n]) != nil {
+					return
+				}
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	for {
+		typ, payload, err := readTTYFrame(conn)
+		if err != nil {
+			return
+		}
+		switch typ {
+		case ttyData:
+			os.Stdout.Write(payload)
+		case ttyExit:
+			code, err := decodeExit(payload)
+			if err != nil {
+				log.Println(err)
+				code = 1
+			}
+			term.Restore(int(os.Stdin.Fd()), oldState)
+			os.Exit(code)
+		}
+	}
+}
+
+func encodeExit(code int) []byte {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, uint32(code))
+	return b
+}
+
+func decodeExit(b []byte) (int, error) {
+	if len(b) < 4 {
+		return 0, fmt.Errorf("short exit frame: %d bytes", len(b))
+	}
+	return int(int32(binary.BigEndian.Uint32(b))), nil
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// writeDeadline bounds how long a single write — either a WriteMessage to
+// the peer's own websocket, or a send into its half of the rendezvous —
+// may stall before that peer is considered too slow to keep relaying to.
+const writeDeadline = 10 * time.Second
+
+// pumpIn drains in, writing each frame to conn under writeDeadline, and
+// returns a channel that's closed once it stops: because in was closed, a
+// write to conn failed or stalled past the deadline, or stop fired. On a
+// failed write it calls closeSlow; the closeSlow that relay and relaybytes
+// pass closes conn with CloseSlowPeer, which also ends their read loop.
+// The peer's own websocket is not closed from here.
+//
+// stop matters because localSlotStore's rendezvous channels (see
+// slotstore.go) are never closed on their own: without it, a peer that
+// stops sending anything would leave this goroutine (and the caller's
+// <-done) blocked past slotTimeout, even though conn itself got closed.
+func pumpIn(conn *websocket.Conn, in <-chan Frame, stop <-chan struct{}, closeSlow func()) <-chan struct{} {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			select {
+			case f, ok := <-in:
+				if !ok {
+					return
+				}
+				conn.SetWriteDeadline(time.Now().Add(writeDeadline))
+				if err := conn.WriteMessage(f.Type, f.Data); err != nil {
+					closeSlow()
+					return
+				}
+				metricRelayMessages.WithLabelValues("out").Inc()
+				metricRelayBytes.WithLabelValues("out").Add(float64(len(f.Data)))
+			case <-stop:
+				return
+			}
+		}
+	}()
+	return done
+}
+
+// sendOut enqueues f on out, giving up after writeDeadline if the peer's
+// half of the rendezvous is still full by then, meaning it isn't draining
+// frames fast enough to keep up.
+func sendOut(out chan<- Frame, f Frame, done <-chan struct{}) bool {
+	t := time.NewTimer(writeDeadline)
+	defer t.Stop()
+	select {
+	case out <- f:
+		return true
+	case <-done:
+		return false
+	case <-t.C:
+		return false
+	}
+}
+
+// closeSlowPeer closes conn with CloseSlowPeer, so its owner knows to
+// retry the transfer rather than have it silently hang for the rest of
+// slotTimeout.
+func closeSlowPeer(conn *websocket.Conn) {
+	conn.WriteControl(
+		websocket.CloseMessage,
+		websocket.FormatCloseMessage(CloseSlowPeer, "peer too slow"),
+		time.Now().Add(10*time.Second),
+	)
+	conn.Close()
+}